@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/customer"
+	"time"
+)
+
+// Account associates a padlock account with its Stripe customer and subscription state.
+type Account struct {
+	Email      string
+	TrackingID string
+	Customer   *stripe.Customer
+
+	// PaymentFailedAt marks when the account's most recent invoice failed to pay, and is
+	// cleared again once a payment succeeds. The grace period sweep in grace.go downgrades
+	// accounts whose PaymentFailedAt is older than the configured buffer period.
+	PaymentFailedAt *time.Time
+
+	// LastExpiryNotificationAt records the last time the SubscriptionNotifier sent a
+	// renewal/trial-end reminder, so it isn't sent more than once per window.
+	LastExpiryNotificationAt *time.Time
+
+	// LastSubscriptionEventAt is the Created timestamp of the most recent
+	// customer.subscription.* webhook event applied to this account, used by StripeHook
+	// to detect and discard out-of-order deliveries.
+	LastSubscriptionEventAt int64
+}
+
+func (a *Account) Kind() string {
+	return "account"
+}
+
+func (a *Account) Key() []byte {
+	return []byte(a.Email)
+}
+
+// Subscription returns the account's current Stripe subscription, if any.
+func (a *Account) Subscription() *stripe.Sub {
+	if a.Customer == nil || len(a.Customer.Subscriptions.Values) == 0 {
+		return nil
+	}
+	return a.Customer.Subscriptions.Values[0]
+}
+
+func (a *Account) HasActiveSubscription() bool {
+	s := a.Subscription()
+	return s != nil && s.Status == stripe.SubscriptionStatusActive
+}
+
+func (a *Account) SetPaymentSource(token string) error {
+	c, err := customer.Update(a.Customer.ID, &stripe.CustomerParams{
+		Source: &stripe.SourceParams{Token: token},
+	})
+	if err != nil {
+		return err
+	}
+
+	a.Customer = c
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+// StripeConfig holds the credentials and settings used to talk to the Stripe API,
+// loaded the same way as the rest of the server configuration (flag/env/YAML).
+type StripeConfig struct {
+	PublicKey string `yaml:"public_key"`
+	SecretKey string `yaml:"secret_key"`
+
+	// EndpointSecret is the signing secret for the configured webhook endpoint, used to
+	// verify the `Stripe-Signature` header on incoming webhook requests.
+	EndpointSecret string `yaml:"endpoint_secret"`
+
+	// Plans lists the subscription tiers offered to accounts. The first entry is used
+	// as the default when a request does not specify one.
+	Plans []PlanConfig `yaml:"plans"`
+
+	// BufferPeriodDays is how long an account is allowed to stay past_due/unpaid before
+	// being downgraded to the free tier. Defaults to defaultBufferPeriodDays.
+	BufferPeriodDays int `yaml:"buffer_period_days"`
+}
+
+// PlanConfig describes a single subscription tier.
+type PlanConfig struct {
+	ID           string   `yaml:"id"`
+	PriceID      string   `yaml:"price_id"`
+	Name         string   `yaml:"name"`
+	MonthlyPrice int      `yaml:"monthly_price"`
+	Features     []string `yaml:"features"`
+}
+
+// Plan looks up a plan by id, falling back to the first configured plan if id is empty.
+// It returns nil if no matching plan is configured.
+func (c *StripeConfig) Plan(id string) *PlanConfig {
+	if id == "" && len(c.Plans) != 0 {
+		return &c.Plans[0]
+	}
+
+	for i := range c.Plans {
+		if c.Plans[i].ID == id {
+			return &c.Plans[i]
+		}
+	}
+
+	return nil
+}
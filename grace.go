@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/stripe/stripe-go/sub"
+	"time"
+)
+
+const defaultBufferPeriodDays = 7
+
+// StartGracePeriodSweep launches a background loop that downgrades accounts whose
+// payment has been failing for longer than the configured grace period.
+func (s *Server) StartGracePeriodSweep() {
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.sweepExpiredGracePeriods()
+		}
+	}()
+}
+
+func (s *Server) sweepExpiredGracePeriods() {
+	bufferDays := s.StripeConfig.BufferPeriodDays
+	if bufferDays == 0 {
+		bufferDays = defaultBufferPeriodDays
+	}
+	cutoff := time.Now().Add(-time.Duration(bufferDays) * 24 * time.Hour)
+
+	accs, err := s.Storage.ListAccounts()
+	if err != nil {
+		s.Error.Printf("grace period sweep - %s", err)
+		return
+	}
+
+	for _, acc := range accs {
+		if acc.PaymentFailedAt == nil || acc.PaymentFailedAt.After(cutoff) {
+			continue
+		}
+
+		if activeSub := acc.Subscription(); activeSub != nil {
+			if _, err := sub.Cancel(activeSub.ID, nil); err != nil {
+				s.Error.Printf("grace period sweep - cancel %s - %s", acc.Email, err)
+				continue
+			}
+		}
+
+		acc.PaymentFailedAt = nil
+		if err := s.Storage.Put(acc); err != nil {
+			s.Error.Printf("grace period sweep - put %s - %s", acc.Email, err)
+			continue
+		}
+
+		go s.Track(&TrackingEvent{
+			TrackingID: acc.TrackingID,
+			Name:       "Payment Grace Expired",
+		}, nil, nil)
+	}
+}
@@ -6,10 +6,15 @@ import (
 	"fmt"
 	pc "github.com/maklesoft/padlock-cloud/padlockcloud"
 	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/billingportal/session"
+	checkoutsession "github.com/stripe/stripe-go/checkout/session"
 	"github.com/stripe/stripe-go/customer"
 	"github.com/stripe/stripe-go/sub"
+	"github.com/stripe/stripe-go/webhook"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Dashboard struct {
@@ -34,6 +39,18 @@ func (h *Dashboard) Handle(w http.ResponseWriter, r *http.Request, auth *pc.Auth
 			"status":   sub.Status,
 			"trialEnd": sub.TrialEnd,
 		}
+
+		plans := make([]map[string]interface{}, len(h.StripeConfig.Plans))
+		for i, p := range h.StripeConfig.Plans {
+			plans[i] = map[string]interface{}{
+				"id":           p.ID,
+				"name":         p.Name,
+				"monthlyPrice": p.MonthlyPrice,
+				"features":     p.Features,
+				"active":       sub.Plan != nil && sub.Plan.ID == p.PriceID,
+			}
+		}
+		accMap["plans"] = plans
 	}
 
 	if len(subAcc.Customer.Sources.Values) != 0 {
@@ -46,6 +63,23 @@ func (h *Dashboard) Handle(w http.ResponseWriter, r *http.Request, auth *pc.Auth
 
 	accMap["displaySubscription"] = !NoSubRequired(auth)
 
+	if subAcc.PaymentFailedAt != nil {
+		bufferDays := h.StripeConfig.BufferPeriodDays
+		if bufferDays == 0 {
+			bufferDays = defaultBufferPeriodDays
+		}
+		remaining := bufferDays - int(time.Since(*subAcc.PaymentFailedAt).Hours()/24)
+		if remaining < 0 {
+			remaining = 0
+		}
+		accMap["graceDaysRemaining"] = remaining
+	}
+
+	// The billing portal session itself is created on demand by the BillingPortal
+	// handler; linking to that route here avoids an extra Stripe API call (and a failure
+	// mode that would take down the whole dashboard) on every page view.
+	accMap["billingPortalURL"] = "/billing-portal/"
+
 	params := pc.DashboardParams(r, auth)
 	params["account"] = accMap
 
@@ -96,19 +130,27 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 		return &pc.InvalidAuthToken{}
 	}
 
+	acc, err := h.AccountFromEmail(a.Account().Email, true)
+	if err != nil {
+		return err
+	}
+
+	if acc.HasActiveSubscription() {
+		http.Redirect(w, r, "/billing-portal/", http.StatusSeeOther)
+		return nil
+	}
+
 	token := r.PostFormValue("stripeToken")
 
 	if token == "" {
 		return &pc.BadRequest{"No stripe token provided"}
 	}
 
-	acc, err := h.AccountFromEmail(a.Account().Email, true)
-	if err != nil {
-		return err
+	plan := h.StripeConfig.Plan(r.PostFormValue("plan"))
+	if plan == nil {
+		return &pc.BadRequest{"Invalid plan"}
 	}
 
-	newSubscription := !acc.HasActiveSubscription()
-
 	if err := acc.SetPaymentSource(token); err != nil {
 		return wrapCardError(err)
 	}
@@ -119,7 +161,10 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 	}
 
 	if s_, err := sub.Update(s.ID, &stripe.SubParams{
-		TrialEndNow: true,
+		TrialEndNow:   true,
+		Plan:          plan.PriceID,
+		Coupon:        r.PostFormValue("coupon"),
+		PromotionCode: r.PostFormValue("promotion_code"),
 	}); err != nil {
 		return wrapCardError(err)
 	} else {
@@ -130,24 +175,14 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 		return err
 	}
 
-	var eventName string
-	var action string
-	if newSubscription {
-		eventName = "Buy Subscription"
-		action = "subscribed"
-	} else {
-		eventName = "Update Payment Method"
-		action = "payment-updated"
-	}
-
-	http.Redirect(w, r, "/dashboard/?action="+action, http.StatusFound)
+	http.Redirect(w, r, "/dashboard/?action=subscribed", http.StatusFound)
 
 	h.Info.Printf("%s - subcribe - %s\n", pc.FormatRequest(r), acc.Email)
 
 	go h.Track(&TrackingEvent{
-		Name: eventName,
+		Name: "Buy Subscription",
 		Properties: map[string]interface{}{
-			"Plan":   s.Plan.ID,
+			"Plan":   plan.ID,
 			"Source": sourceFromRef(r.URL.Query().Get("ref")),
 		},
 	}, r, a)
@@ -155,39 +190,100 @@ func (h *Subscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTok
 	return nil
 }
 
+// Unsubscribe used to cancel a subscription directly via the Stripe API. Cancellation,
+// plan changes and invoice history are now handled by Stripe's hosted billing portal, so
+// this simply forwards there.
 type Unsubscribe struct {
 	*Server
 }
 
 func (h *Unsubscribe) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	http.Redirect(w, r, "/billing-portal/", http.StatusSeeOther)
+	return nil
+}
+
+type Checkout struct {
+	*Server
+}
+
+func (h *Checkout) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
 	acc, err := h.AccountFromEmail(a.Account().Email, true)
 	if err != nil {
 		return err
 	}
 
-	s := acc.Subscription()
+	if acc.HasActiveSubscription() {
+		http.Redirect(w, r, "/billing-portal/", http.StatusSeeOther)
+		return nil
+	}
 
-	if s == nil {
-		return &pc.BadRequest{"This account does not have an active subscription"}
+	plan := h.StripeConfig.Plan(r.URL.Query().Get("plan"))
+	if plan == nil {
+		return &pc.BadRequest{"Invalid plan"}
 	}
 
-	if s_, err := sub.Cancel(s.ID, nil); err != nil {
-		return err
-	} else {
-		*s = *s_
+	params := &stripe.CheckoutSessionParams{
+		Customer:   stripe.String(acc.Customer.ID),
+		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		SuccessURL: stripe.String(h.BaseURL + "/dashboard/?action=subscribed"),
+		CancelURL:  stripe.String(h.BaseURL + "/dashboard/"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    stripe.String(plan.PriceID),
+				Quantity: stripe.Int64(1),
+			},
+		},
 	}
 
-	if err := h.Storage.Put(acc); err != nil {
+	if promoCode := r.URL.Query().Get("promotion_code"); promoCode != "" {
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{{PromotionCode: stripe.String(promoCode)}}
+	} else if coupon := r.URL.Query().Get("coupon"); coupon != "" {
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{{Coupon: stripe.String(coupon)}}
+	}
+
+	s, err := checkoutsession.New(params)
+	if err != nil {
+		return wrapCardError(err)
+	}
+
+	http.Redirect(w, r, s.URL, http.StatusSeeOther)
+
+	h.Info.Printf("%s - checkout - %s\n", pc.FormatRequest(r), acc.Email)
+
+	return nil
+}
+
+// BillingPortal sends the account to Stripe's hosted billing portal, where they can
+// update their payment method, change plans, cancel, and review past invoices.
+type BillingPortal struct {
+	*Server
+}
+
+func (h *BillingPortal) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil {
+		return &pc.InvalidAuthToken{}
+	}
+
+	acc, err := h.AccountFromEmail(a.Account().Email, true)
+	if err != nil {
 		return err
 	}
 
-	http.Redirect(w, r, "/dashboard/?action=unsubscribed", http.StatusFound)
+	s, err := session.New(&stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(acc.Customer.ID),
+		ReturnURL: stripe.String(h.BaseURL + "/dashboard/"),
+	})
+	if err != nil {
+		return err
+	}
 
-	h.Info.Printf("%s - unsubscribe - %s\n", pc.FormatRequest(r), acc.Email)
+	http.Redirect(w, r, s.URL, http.StatusSeeOther)
 
-	go h.Track(&TrackingEvent{
-		Name: "Cancel Subscription",
-	}, r, a)
+	h.Info.Printf("%s - billing_portal - %s\n", pc.FormatRequest(r), acc.Email)
 
 	return nil
 }
@@ -201,9 +297,18 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 	if err != nil {
 		return err
 	}
-	event := &stripe.Event{}
-	if err := json.Unmarshal(body, event); err != nil {
-		return err
+
+	event, err := webhook.ConstructEvent(body, r.Header.Get("Stripe-Signature"), h.StripeConfig.EndpointSecret)
+	if err != nil {
+		return &pc.BadRequest{"Invalid signature"}
+	}
+
+	logEntry := &StripeEventLogEntry{ID: event.ID}
+	if err := h.Storage.Get(logEntry); err == nil {
+		// Already processed this event; Stripe retries deliveries aggressively, so ack
+		// without reapplying it.
+		w.WriteHeader(http.StatusOK)
+		return nil
 	}
 
 	var c *stripe.Customer
@@ -215,11 +320,39 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 			return err
 		}
 
-	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted", "customer.source.updated":
+		// The event payload for these is the subscription/source object, not the customer
+		// itself, so fetch the customer id off the raw object rather than unmarshaling the
+		// payload directly into a Customer.
 		var err error
 		if c, err = customer.Get(event.GetObjValue("customer"), nil); err != nil {
 			return err
 		}
+
+	case "invoice.payment_succeeded", "invoice.payment_failed":
+		invoice := &stripe.Invoice{}
+		if err := json.Unmarshal(event.Data.Raw, invoice); err != nil {
+			return err
+		}
+		if invoice.Customer != nil {
+			// Fetch the full customer rather than trusting the invoice payload alone: the
+			// cached acc.Customer gets overwritten with whatever we find here below, and a
+			// bare {ID, Email} stub would wipe out its Subscriptions/Sources.
+			if c, err = customer.Get(invoice.Customer.ID, nil); err != nil {
+				return err
+			}
+		}
+
+	case "checkout.session.completed":
+		checkoutSession := &stripe.CheckoutSession{}
+		if err := json.Unmarshal(event.Data.Raw, checkoutSession); err != nil {
+			return err
+		}
+		if checkoutSession.Customer != nil {
+			if c, err = customer.Get(checkoutSession.Customer.ID, nil); err != nil {
+				return err
+			}
+		}
 	}
 
 	if c != nil {
@@ -228,6 +361,13 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 			return err
 		}
 
+		if event.Type == "customer.subscription.updated" && event.Created <= acc.LastSubscriptionEventAt {
+			// A later event already moved this subscription forward; a delayed, out-of-order
+			// delivery of this one must not clobber it.
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}
+
 		// Only update customer if the ids match (even though that theoretically shouldn't happen,
 		// it's possible that there are two stripe customers with the same email. In that case, this guard
 		// against unexpected behaviour by making sure only one of the customers is used)
@@ -235,16 +375,74 @@ func (h *StripeHook) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthTo
 			acc.Customer = c
 		}
 
+		if strings.HasPrefix(string(event.Type), "customer.subscription.") && event.Created > acc.LastSubscriptionEventAt {
+			acc.LastSubscriptionEventAt = event.Created
+		}
+
+		switch event.Type {
+		case "invoice.payment_failed":
+			now := time.Now()
+			acc.PaymentFailedAt = &now
+		case "invoice.payment_succeeded":
+			acc.PaymentFailedAt = nil
+		}
+
 		if err := h.Storage.Put(acc); err != nil {
 			return err
 		}
 
+		if event.Type == "invoice.payment_failed" {
+			go h.sendPaymentFailedEmail(acc, 0)
+			go h.schedulePaymentFailedReminders(acc)
+		}
+
 		h.Info.Printf("%s - stripe_hook - %s:%s", pc.FormatRequest(r), acc.Email, event.Type)
 	}
 
+	// Only mark the event processed once it has actually been applied: if anything above
+	// failed, Stripe will retry with the same event id, and that retry needs to see this
+	// id as unprocessed rather than being silently (and permanently) ack'd.
+	logEntry.Type = string(event.Type)
+	logEntry.Created = event.Created
+	logEntry.ProcessedAt = time.Now().Unix()
+	if err := h.Storage.Put(logEntry); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// sendPaymentFailedEmail notifies the account that their most recent invoice failed to
+// pay, with a link to the billing portal so they can update their card. daysSince is
+// included so reminder emails can reference how long the card has been failing.
+func (h *Server) sendPaymentFailedEmail(acc *Account, daysSince int) {
+	if err := h.Email.Send(acc.Email, "payment_failed", map[string]interface{}{
+		"billingPortalURL": h.BaseURL + "/billing-portal/",
+		"daysSince":        daysSince,
+	}); err != nil {
+		h.Error.Printf("stripe_hook - payment failed email - %s - %s", acc.Email, err)
+	}
+}
+
+// schedulePaymentFailedReminders requeues the "please update your card" email for day 3
+// and day 6 of the grace period, bailing out if the payment was fixed in the meantime.
+func (h *Server) schedulePaymentFailedReminders(acc *Account) {
+	for _, days := range []int{3, 6} {
+		days := days
+		time.AfterFunc(time.Duration(days)*24*time.Hour, func() {
+			fresh, err := h.AccountFromEmail(acc.Email, true)
+			if err != nil {
+				h.Error.Printf("stripe_hook - payment failed reminder - %s - %s", acc.Email, err)
+				return
+			}
+			if fresh.PaymentFailedAt == nil {
+				return
+			}
+			h.sendPaymentFailedEmail(fresh, days)
+		})
+	}
+}
+
 type Track struct {
 	*Server
 }
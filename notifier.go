@@ -0,0 +1,115 @@
+package main
+
+import "time"
+
+const defaultNotificationCheckIntervalHours = 24
+
+var defaultNotificationLookaheadDays = []int{7, 1}
+
+// NotificationsConfig controls the SubscriptionNotifier background job.
+type NotificationsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// CheckIntervalHours is how often to scan for upcoming renewals/trial ends.
+	// Defaults to defaultNotificationCheckIntervalHours.
+	CheckIntervalHours int `yaml:"check_interval_hours"`
+
+	// LookaheadDays lists how many days ahead of CurrentPeriodEnd/TrialEnd a reminder
+	// should be sent. Defaults to defaultNotificationLookaheadDays.
+	LookaheadDays []int `yaml:"lookahead_days"`
+}
+
+// SubscriptionNotifier periodically reminds accounts whose subscription renewal or
+// trial end is coming up, so they aren't surprised by a charge or a lapse.
+type SubscriptionNotifier struct {
+	*Server
+}
+
+// Start launches the background scan loop. It is a no-op if notifications are disabled.
+func (n *SubscriptionNotifier) Start() {
+	if !n.NotificationsConfig.Enabled {
+		return
+	}
+
+	interval := n.NotificationsConfig.CheckIntervalHours
+	if interval == 0 {
+		interval = defaultNotificationCheckIntervalHours
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			n.check()
+		}
+	}()
+}
+
+func (n *SubscriptionNotifier) check() {
+	lookahead := n.NotificationsConfig.LookaheadDays
+	if len(lookahead) == 0 {
+		lookahead = defaultNotificationLookaheadDays
+	}
+
+	interval := n.NotificationsConfig.CheckIntervalHours
+	if interval == 0 {
+		interval = defaultNotificationCheckIntervalHours
+	}
+
+	accs, err := n.Storage.ListAccounts()
+	if err != nil {
+		n.Error.Printf("subscription notifier - %s", err)
+		return
+	}
+
+	now := time.Now()
+
+	for _, acc := range accs {
+		activeSub := acc.Subscription()
+		if activeSub == nil {
+			continue
+		}
+
+		expiry := time.Unix(activeSub.CurrentPeriodEnd, 0)
+		if activeSub.TrialEnd > now.Unix() {
+			expiry = time.Unix(activeSub.TrialEnd, 0)
+		}
+
+		for _, days := range lookahead {
+			// Each lookahead day gets its own band, one check interval wide, so that a
+			// single scan only ever matches the band it actually falls in rather than
+			// every band from here to the expiry itself (which would let a larger "days"
+			// value swallow the more urgent, smaller ones).
+			window := expiry.Add(-time.Duration(days) * 24 * time.Hour)
+			windowEnd := window.Add(time.Duration(interval) * time.Hour)
+			if now.Before(window) || !now.Before(windowEnd) {
+				continue
+			}
+			if acc.LastExpiryNotificationAt != nil && !acc.LastExpiryNotificationAt.Before(window) {
+				continue
+			}
+
+			if err := n.Email.Send(acc.Email, "subscription_expiring", map[string]interface{}{
+				"daysRemaining": days,
+			}); err != nil {
+				n.Error.Printf("subscription notifier - email %s - %s", acc.Email, err)
+				break
+			}
+
+			acc.LastExpiryNotificationAt = &now
+			if err := n.Storage.Put(acc); err != nil {
+				n.Error.Printf("subscription notifier - put %s - %s", acc.Email, err)
+			}
+
+			go n.Track(&TrackingEvent{
+				TrackingID: acc.TrackingID,
+				Name:       "Subscription Expiring",
+				Properties: map[string]interface{}{
+					"DaysRemaining": days,
+				},
+			}, nil, nil)
+
+			break
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	pc "github.com/maklesoft/padlock-cloud/padlockcloud"
+	"net/http"
+)
+
+// handler is implemented by every *.Handle-style endpoint in this package.
+type handler interface {
+	Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error
+}
+
+// wrap adapts a handler to net/http, authenticating the request and, when required is
+// true, rejecting it before the handler ever runs.
+func (s *Server) wrap(h handler, required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, err := pc.Authenticate(r)
+		if required && (err != nil || a == nil) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := h.Handle(w, r, a); err != nil {
+			pc.HandleError(w, err)
+		}
+	}
+}
+
+// SetupRoutes registers all of this server's HTTP endpoints on mux.
+func (s *Server) SetupRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard/", s.wrap(&Dashboard{s}, true))
+	mux.HandleFunc("/subscribe/", s.wrap(&Subscribe{s}, true))
+	mux.HandleFunc("/unsubscribe/", s.wrap(&Unsubscribe{s}, true))
+	mux.HandleFunc("/checkout/", s.wrap(&Checkout{s}, true))
+	mux.HandleFunc("/billing-portal/", s.wrap(&BillingPortal{s}, true))
+	mux.HandleFunc("/stripe/hook/", s.wrap(&StripeHook{s}, false))
+	mux.HandleFunc("/stripe/events/", s.wrap(&StripeEvents{s}, true))
+	mux.HandleFunc("/track/", s.wrap(&Track{s}, false))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"html/template"
+	"log"
+)
+
+// EmailSender delivers templated transactional emails, e.g. dunning and renewal
+// reminders.
+type EmailSender interface {
+	Send(to string, template string, data map[string]interface{}) error
+}
+
+// Server holds the shared dependencies used by the HTTP handlers and background jobs in
+// this package.
+type Server struct {
+	Storage Storage
+
+	Templates struct {
+		Dashboard *template.Template
+	}
+
+	StripeConfig        StripeConfig
+	NotificationsConfig NotificationsConfig
+	MixpanelConfig      struct{ Token string }
+
+	// AdminEmails lists the accounts allowed to hit admin-only endpoints such as
+	// StripeEvents.
+	AdminEmails []string
+
+	BaseURL string
+	Email   EmailSender
+
+	Info  *log.Logger
+	Error *log.Logger
+}
@@ -0,0 +1,22 @@
+package main
+
+// Storable is implemented by types that can be stored directly via Storage.Get/Put.
+type Storable interface {
+	Kind() string
+	Key() []byte
+}
+
+// Storage is the persistence layer accounts and webhook bookkeeping are read from and
+// written to.
+type Storage interface {
+	Get(s Storable) error
+	Put(s Storable) error
+
+	// ListAccounts returns every stored account, used by the grace period sweep and the
+	// subscription expiry notifier to scan for accounts that need attention.
+	ListAccounts() ([]*Account, error)
+
+	// ListStripeEventLog returns the most recently processed webhook events, newest
+	// first, for the admin debug endpoint.
+	ListStripeEventLog(limit int) ([]*StripeEventLogEntry, error)
+}
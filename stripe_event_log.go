@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	pc "github.com/maklesoft/padlock-cloud/padlockcloud"
+	"net/http"
+)
+
+// StripeEventLogEntry records that a Stripe webhook event has been processed, so that
+// Stripe's aggressive retried deliveries are recognized and skipped instead of being
+// reapplied.
+type StripeEventLogEntry struct {
+	ID          string
+	Type        string
+	Created     int64
+	ProcessedAt int64
+}
+
+func (e *StripeEventLogEntry) Kind() string {
+	return "stripe-event-log"
+}
+
+func (e *StripeEventLogEntry) Key() []byte {
+	return []byte(e.ID)
+}
+
+// StripeEvents is a small admin endpoint for listing recently processed webhook
+// events, for debugging delivery/dedup issues.
+type StripeEvents struct {
+	*Server
+}
+
+// isAdmin reports whether email belongs to one of the server's configured admins.
+func (s *Server) isAdmin(email string) bool {
+	for _, adminEmail := range s.AdminEmails {
+		if adminEmail == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *StripeEvents) Handle(w http.ResponseWriter, r *http.Request, a *pc.AuthToken) error {
+	if a == nil || !h.isAdmin(a.Account().Email) {
+		return &pc.Unauthorized{}
+	}
+
+	entries, err := h.Storage.ListStripeEventLog(100)
+	if err != nil {
+		return err
+	}
+
+	response, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+
+	return nil
+}